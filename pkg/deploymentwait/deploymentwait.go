@@ -0,0 +1,161 @@
+// Package deploymentwait provides a rollout-readiness check for Kubernetes
+// Deployments, modeled on the algorithm Helm 3.5's statuscheck package uses
+// to decide a Deployment rollout has actually finished rather than merely
+// reporting a ready-replica count that happens to match. A naive
+// ReadyReplicas comparison can briefly be satisfied while old and new
+// ReplicaSets both have ready pods, which this package avoids by resolving
+// the Deployment's current ReplicaSet and checking its pods directly.
+package deploymentwait
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// revisionAnnotation is the annotation the Deployment controller stamps on
+// both a Deployment and its owned ReplicaSets to record which ReplicaSet is
+// current.
+const revisionAnnotation = "deployment.kubernetes.io/revision"
+
+// WaitForRollout blocks, using the given backoff, until the Deployment
+// identified by namespace/name has fully rolled out: status.observedGeneration
+// has caught up with metadata.generation, status.updatedReplicas,
+// status.availableReplicas and status.replicas all match spec.replicas (so no
+// surge remnants from a prior ReplicaSet remain), and every pod belonging to
+// the current ReplicaSet - the one whose deployment.kubernetes.io/revision
+// annotation matches the Deployment's - is Ready and not terminating. It
+// returns the pod list of that current ReplicaSet only, so callers never
+// observe a pod still serving a pre-rollout workload.
+func WaitForRollout(ctx context.Context, clientset kubernetes.Interface, namespace, name string, backoff wait.Backoff) (*v1.PodList, error) {
+	var currentPods *v1.PodList
+
+	err := wait.ExponentialBackoffWithContext(ctx, backoff, func(ctx context.Context) (bool, error) {
+		deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, fmt.Errorf("getting deployment %s/%s: %w", namespace, name, err)
+		}
+
+		if !deploymentSettled(deployment) {
+			return false, nil
+		}
+
+		rs, err := currentReplicaSet(ctx, clientset, deployment)
+		if err != nil {
+			return false, err
+		}
+		if rs == nil {
+			return false, nil
+		}
+
+		pods, err := podsForReplicaSet(ctx, clientset, rs)
+		if err != nil {
+			return false, err
+		}
+		if !allPodsReady(pods) {
+			return false, nil
+		}
+
+		currentPods = pods
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return currentPods, nil
+}
+
+// deploymentSettled reports whether the Deployment's status has caught up
+// with its spec: the controller has observed the latest generation, every
+// replica has been updated to that generation, every updated replica is
+// available, and no surge replicas from a prior ReplicaSet remain.
+func deploymentSettled(deployment *appsv1.Deployment) bool {
+	if deployment.Generation != deployment.Status.ObservedGeneration {
+		return false
+	}
+
+	desired := int32(1)
+	if deployment.Spec.Replicas != nil {
+		desired = *deployment.Spec.Replicas
+	}
+
+	return deployment.Status.UpdatedReplicas == desired &&
+		deployment.Status.AvailableReplicas >= desired &&
+		deployment.Status.Replicas == desired
+}
+
+// currentReplicaSet returns the ReplicaSet that owns the Deployment's
+// current revision, as recorded in its deployment.kubernetes.io/revision
+// annotation. It returns a nil ReplicaSet, rather than an error, while the
+// matching ReplicaSet has not shown up yet.
+func currentReplicaSet(ctx context.Context, clientset kubernetes.Interface, deployment *appsv1.Deployment) (*appsv1.ReplicaSet, error) {
+	revision := deployment.Annotations[revisionAnnotation]
+	if revision == "" {
+		return nil, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("parsing selector for deployment %s/%s: %w", deployment.Namespace, deployment.Name, err)
+	}
+
+	replicaSets, err := clientset.AppsV1().ReplicaSets(deployment.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing replica sets for deployment %s/%s: %w", deployment.Namespace, deployment.Name, err)
+	}
+
+	for i := range replicaSets.Items {
+		rs := &replicaSets.Items[i]
+		if rs.Annotations[revisionAnnotation] == revision {
+			return rs, nil
+		}
+	}
+	return nil, nil
+}
+
+// podsForReplicaSet returns the pods carrying the ReplicaSet's
+// pod-template-hash label, which is how its own pods are distinguished from
+// ones still owned by a prior ReplicaSet mid-rollout.
+func podsForReplicaSet(ctx context.Context, clientset kubernetes.Interface, rs *appsv1.ReplicaSet) (*v1.PodList, error) {
+	hash := rs.Labels[appsv1.DefaultDeploymentUniqueLabelKey]
+	if hash == "" {
+		return &v1.PodList{}, nil
+	}
+
+	return clientset.CoreV1().Pods(rs.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", appsv1.DefaultDeploymentUniqueLabelKey, hash),
+	})
+}
+
+// allPodsReady reports whether the pod list is non-empty and every pod in it
+// is both Ready and not in the process of terminating.
+func allPodsReady(pods *v1.PodList) bool {
+	if len(pods.Items) == 0 {
+		return false
+	}
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp != nil {
+			return false
+		}
+		if !podReady(pod) {
+			return false
+		}
+	}
+	return true
+}
+
+func podReady(pod v1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.PodReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package kdm
+
+import (
+	"context"
+	"fmt"
+)
+
+// ConfigMapSource points Rancher at a ConfigMap the caller has already
+// created in target.Namespace, for scenarios where the KDM bundle is
+// delivered out of band - an air-gapped cluster or an offline install
+// bundle - rather than fetched by Rancher itself.
+type ConfigMapSource struct {
+	// ConfigMapName is an existing ConfigMap in the target namespace holding
+	// a data.json key.
+	ConfigMapName string
+}
+
+func (s ConfigMapSource) Name() string {
+	return fmt.Sprintf("configmap:%s", s.ConfigMapName)
+}
+
+func (s ConfigMapSource) Apply(ctx context.Context, target Target) (func(ctx context.Context) error, error) {
+	previous, err := target.Settings.KDMSettingValue()
+	if err != nil {
+		return nil, fmt.Errorf("reading kdm setting: %w", err)
+	}
+
+	unmount, err := mountConfigMap(ctx, target, s.ConfigMapName)
+	if err != nil {
+		return nil, err
+	}
+
+	value := cloneSetting(previous)
+	value["url"] = fileURL()
+	if err := target.Settings.SetKDMSettingValue(value); err != nil {
+		_ = unmount(ctx)
+		return nil, fmt.Errorf("pointing kdm setting at configmap %s: %w", s.ConfigMapName, err)
+	}
+
+	return func(ctx context.Context) error {
+		settingErr := target.Settings.SetKDMSettingValue(previous)
+		mountErr := unmount(ctx)
+		return firstNonNil(settingErr, mountErr)
+	}, nil
+}
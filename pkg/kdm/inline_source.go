@@ -0,0 +1,63 @@
+package kdm
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// InlineJSONSource embeds a data.json payload directly into the test run:
+// it sideloads the payload into a ConfigMap this package creates, mounts it
+// into the rancher deployment, and points the setting at it with
+// refresh-interval-minutes set to 0 so Rancher never tries to re-fetch a
+// bundle that, by construction, isn't reachable over the network. This is
+// what lets a test assert against an exact, known-bad or known-good KDM
+// payload instead of whatever the upstream release happens to contain.
+type InlineJSONSource struct {
+	// Data is the KDM data.json payload to serve.
+	Data []byte
+}
+
+func (s InlineJSONSource) Name() string {
+	return "inline-json"
+}
+
+func (s InlineJSONSource) Apply(ctx context.Context, target Target) (func(ctx context.Context) error, error) {
+	previous, err := target.Settings.KDMSettingValue()
+	if err != nil {
+		return nil, fmt.Errorf("reading kdm setting: %w", err)
+	}
+
+	configMapName := fmt.Sprintf("kdm-inline-%s", target.DeploymentName)
+	_, err = target.Clientset.CoreV1().ConfigMaps(target.Namespace).Create(ctx, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: configMapName, Namespace: target.Namespace},
+		Data:       map[string]string{dataFile: string(s.Data)},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("creating inline kdm configmap %s: %w", configMapName, err)
+	}
+
+	unmount, err := mountConfigMap(ctx, target, configMapName)
+	if err != nil {
+		_ = target.Clientset.CoreV1().ConfigMaps(target.Namespace).Delete(ctx, configMapName, metav1.DeleteOptions{})
+		return nil, err
+	}
+
+	value := cloneSetting(previous)
+	value["url"] = fileURL()
+	value["refresh-interval-minutes"] = "0"
+	if err := target.Settings.SetKDMSettingValue(value); err != nil {
+		_ = unmount(ctx)
+		_ = target.Clientset.CoreV1().ConfigMaps(target.Namespace).Delete(ctx, configMapName, metav1.DeleteOptions{})
+		return nil, fmt.Errorf("pointing kdm setting at inline data: %w", err)
+	}
+
+	return func(ctx context.Context) error {
+		settingErr := target.Settings.SetKDMSettingValue(previous)
+		mountErr := unmount(ctx)
+		deleteErr := target.Clientset.CoreV1().ConfigMaps(target.Namespace).Delete(ctx, configMapName, metav1.DeleteOptions{})
+		return firstNonNil(settingErr, mountErr, deleteErr)
+	}, nil
+}
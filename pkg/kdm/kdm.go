@@ -0,0 +1,160 @@
+// Package kdm configures where Rancher loads its Kontainer Driver Metadata
+// (KDM) bundle from. The rke-metadata-config setting always resolves to a
+// single URL, but that URL can point at a public HTTP(S) endpoint, a
+// data.json blob embedded in a ConfigMap this package creates, or a
+// ConfigMap a caller supplies out of band - which is how air-gapped and
+// offline-bundle scenarios get covered without a reachable upstream.
+package kdm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/rancher/rancher/pkg/deploymentwait"
+)
+
+const (
+	volumeName = "kdm-data"
+	mountPath  = "/etc/rancher/kdm"
+	dataFile   = "data.json"
+)
+
+var defaultBackoff = wait.Backoff{
+	Duration: 1 * time.Second,
+	Factor:   2.0,
+	Steps:    7,
+}
+
+// SettingUpdater reads and writes the rke-metadata-config setting's value.
+// Callers implement it against whatever client they use to reach Rancher
+// (Steve, the management client, ...) so KDMSource implementations never
+// need to know about that client directly.
+type SettingUpdater interface {
+	KDMSettingValue() (map[string]string, error)
+	SetKDMSettingValue(value map[string]string) error
+}
+
+// Target is the environment a KDMSource configures: the rke-metadata-config
+// setting, plus the Rancher deployment sources that mount data into the
+// pods need to patch.
+type Target struct {
+	Settings       SettingUpdater
+	Clientset      kubernetes.Interface
+	Namespace      string
+	DeploymentName string
+}
+
+// KDMSource points Rancher's KDM setting at a particular backend for the
+// duration of a test. Apply configures the target and returns a rollback
+// func that undoes whatever it changed; callers should run rollback during
+// teardown regardless of how the test using it concluded.
+type KDMSource interface {
+	// Name identifies the source in test names and log output.
+	Name() string
+	// Apply points the target at this source, returning a func that restores
+	// the target's prior configuration.
+	Apply(ctx context.Context, target Target) (rollback func(ctx context.Context) error, err error)
+}
+
+func cloneSetting(value map[string]string) map[string]string {
+	cloned := make(map[string]string, len(value))
+	for k, v := range value {
+		cloned[k] = v
+	}
+	return cloned
+}
+
+func firstNonNil(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountConfigMap patches the target deployment so the named ConfigMap is
+// mounted read-only at mountPath in every container, waiting for the
+// resulting rollout to settle before returning. The returned rollback func
+// removes the volume and mount again and waits for that rollout in turn.
+func mountConfigMap(ctx context.Context, target Target, configMapName string) (func(ctx context.Context) error, error) {
+	deployment, err := target.Clientset.AppsV1().Deployments(target.Namespace).Get(ctx, target.DeploymentName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting deployment %s/%s: %w", target.Namespace, target.DeploymentName, err)
+	}
+
+	patched := deployment.DeepCopy()
+	patched.Spec.Template.Spec.Volumes = append(patched.Spec.Template.Spec.Volumes, corev1.Volume{
+		Name: volumeName,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: configMapName},
+			},
+		},
+	})
+	for i := range patched.Spec.Template.Spec.Containers {
+		patched.Spec.Template.Spec.Containers[i].VolumeMounts = append(patched.Spec.Template.Spec.Containers[i].VolumeMounts, corev1.VolumeMount{
+			Name:      volumeName,
+			MountPath: mountPath,
+			ReadOnly:  true,
+		})
+	}
+
+	if _, err := target.Clientset.AppsV1().Deployments(target.Namespace).Update(ctx, patched, metav1.UpdateOptions{}); err != nil {
+		return nil, fmt.Errorf("mounting configmap %s into deployment %s/%s: %w", configMapName, target.Namespace, target.DeploymentName, err)
+	}
+	if _, err := deploymentwait.WaitForRollout(ctx, target.Clientset, target.Namespace, target.DeploymentName, defaultBackoff); err != nil {
+		return nil, fmt.Errorf("waiting for deployment to mount configmap %s: %w", configMapName, err)
+	}
+
+	return func(ctx context.Context) error {
+		deployment, err := target.Clientset.AppsV1().Deployments(target.Namespace).Get(ctx, target.DeploymentName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("getting deployment %s/%s: %w", target.Namespace, target.DeploymentName, err)
+		}
+
+		restored := deployment.DeepCopy()
+		restored.Spec.Template.Spec.Volumes = removeVolume(restored.Spec.Template.Spec.Volumes, volumeName)
+		for i := range restored.Spec.Template.Spec.Containers {
+			restored.Spec.Template.Spec.Containers[i].VolumeMounts = removeVolumeMount(restored.Spec.Template.Spec.Containers[i].VolumeMounts, volumeName)
+		}
+
+		if _, err := target.Clientset.AppsV1().Deployments(target.Namespace).Update(ctx, restored, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("unmounting configmap %s from deployment %s/%s: %w", configMapName, target.Namespace, target.DeploymentName, err)
+		}
+		_, err = deploymentwait.WaitForRollout(ctx, target.Clientset, target.Namespace, target.DeploymentName, defaultBackoff)
+		return err
+	}, nil
+}
+
+func removeVolume(volumes []corev1.Volume, name string) []corev1.Volume {
+	kept := volumes[:0]
+	for _, v := range volumes {
+		if v.Name != name {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+func removeVolumeMount(mounts []corev1.VolumeMount, name string) []corev1.VolumeMount {
+	kept := mounts[:0]
+	for _, m := range mounts {
+		if m.Name != name {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// fileURL builds the file:// URL the rke-metadata-config setting's url key
+// must hold to read data.json from a ConfigMap mounted at mountPath.
+func fileURL() string {
+	return fmt.Sprintf("file://%s/%s", mountPath, dataFile)
+}
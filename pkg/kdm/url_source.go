@@ -0,0 +1,34 @@
+package kdm
+
+import (
+	"context"
+	"fmt"
+)
+
+// URLSource points the rke-metadata-config setting's url key directly at a
+// public HTTP(S) endpoint serving a KDM data.json, the mechanism Rancher
+// uses in normal operation.
+type URLSource struct {
+	URL string
+}
+
+func (s URLSource) Name() string {
+	return fmt.Sprintf("url:%s", s.URL)
+}
+
+func (s URLSource) Apply(ctx context.Context, target Target) (func(ctx context.Context) error, error) {
+	previous, err := target.Settings.KDMSettingValue()
+	if err != nil {
+		return nil, fmt.Errorf("reading kdm setting: %w", err)
+	}
+
+	value := cloneSetting(previous)
+	value["url"] = s.URL
+	if err := target.Settings.SetKDMSettingValue(value); err != nil {
+		return nil, fmt.Errorf("setting kdm url to %s: %w", s.URL, err)
+	}
+
+	return func(ctx context.Context) error {
+		return target.Settings.SetKDMSettingValue(previous)
+	}, nil
+}
@@ -0,0 +1,303 @@
+// Package verify cross-checks KDM (Kontainer Driver Metadata) freshness
+// across every replica of a Rancher deployment. A substring match against a
+// single pod's response can't tell a full refresh from a partial one (RKE2
+// updated but K3s stale, say) and can't tell whether replicas agree with
+// each other at all; this package fetches every distribution's release feed
+// from every pod, hashes each canonically, and reports divergence and
+// staleness structurally instead of as a raw first-mismatch error.
+package verify
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	rke2ReleasesPath = "/v1-rke2-release/releases"
+	k3sReleasesPath  = "/v1-k3s-release/releases"
+	rkeReleasesPath  = "/v1-rke-release/releases"
+	uiDriverPath     = "/v1-ui-driver-metadata"
+)
+
+// Execer runs cmd inside pod and returns its stdout. KDMTestSuite's
+// ExecCMDForKDMDump method value satisfies this.
+type Execer func(pod corev1.Pod, cmd []string) string
+
+// RKE2Releases is the typed shape of /v1-rke2-release/releases.
+type RKE2Releases struct {
+	RKE2Versions map[string]json.RawMessage `json:"rke2Versions"`
+}
+
+// K3sReleases is the typed shape of /v1-k3s-release/releases.
+type K3sReleases struct {
+	K3sVersions map[string]json.RawMessage `json:"k3sVersions"`
+}
+
+// RKEReleases is the typed shape of /v1-rke-release/releases.
+type RKEReleases struct {
+	RKESystemImages map[string]json.RawMessage `json:"RKESystemImages"`
+}
+
+// UIDriverMetadata is the typed shape of /v1-ui-driver-metadata: a map
+// keyed by driver name.
+type UIDriverMetadata map[string]json.RawMessage
+
+// DistroDigests is the canonical hash of each distribution's release feed,
+// as reported by a single pod.
+type DistroDigests struct {
+	RKE2     string
+	K3s      string
+	RKE1     string
+	UIDriver string
+}
+
+// ExpectedVersions are the versions a caller expects the latest release
+// feeds to contain. An empty field skips the staleness check for that
+// distribution.
+type ExpectedVersions struct {
+	RKE2 string
+	K3s  string
+	RKE1 string
+}
+
+// ConsistencyReport is the result of comparing every pod's KDM digests
+// against each other and, where requested, against ExpectedVersions.
+// Divergent lists pods whose digests differ from the rest; StaleVersions
+// maps a distribution name to the pods that don't yet report the expected
+// version for it; FetchErrors maps a distribution name to the pods whose
+// feed for it failed to fetch or parse, independently of how the pod's
+// other distributions fared.
+type ConsistencyReport struct {
+	PerPod        map[string]DistroDigests
+	Divergent     []string
+	StaleVersions map[string][]string
+	FetchErrors   map[string][]string
+}
+
+// consistent reports whether every pod agrees, no staleness was found, and
+// every distribution fetched cleanly on every pod.
+func (r ConsistencyReport) consistent() bool {
+	return len(r.Divergent) == 0 && len(r.StaleVersions) == 0 && len(r.FetchErrors) == 0
+}
+
+// DiffTable renders report as a human-readable table for test failure
+// messages, one row per pod and one column per distribution's digest.
+func (r ConsistencyReport) DiffTable() string {
+	names := make([]string, 0, len(r.PerPod))
+	for name := range r.PerPod {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-40s %-12s %-12s %-12s %-12s\n", "POD", "RKE2", "K3S", "RKE1", "UI-DRIVER")
+	for _, name := range names {
+		d := r.PerPod[name]
+		fmt.Fprintf(&b, "%-40s %-12s %-12s %-12s %-12s\n", name, short(d.RKE2), short(d.K3s), short(d.RKE1), short(d.UIDriver))
+	}
+	if len(r.Divergent) > 0 {
+		fmt.Fprintf(&b, "divergent pods: %v\n", r.Divergent)
+	}
+	for distro, pods := range r.StaleVersions {
+		fmt.Fprintf(&b, "stale %s on pods: %v\n", distro, pods)
+	}
+	for distro, pods := range r.FetchErrors {
+		fmt.Fprintf(&b, "fetch failed for %s on pods: %v\n", distro, pods)
+	}
+	return b.String()
+}
+
+func short(digest string) string {
+	if len(digest) > 12 {
+		return digest[:12]
+	}
+	return digest
+}
+
+// Verifier exec's into pods to build ConsistencyReports.
+type Verifier struct {
+	exec Execer
+}
+
+// New returns a Verifier that runs curl commands through exec.
+func New(exec Execer) *Verifier {
+	return &Verifier{exec: exec}
+}
+
+// WaitForConsistency exec's into every pod, computing per-distribution
+// digests, and retries with backoff until every pod agrees and - for any
+// distribution named in expected - the latest release feed actually
+// contains that version. It returns the last ConsistencyReport observed,
+// which records a full pod-by-pod diff whether or not the wait succeeded.
+func (v *Verifier) WaitForConsistency(ctx context.Context, pods []corev1.Pod, expected ExpectedVersions, backoff wait.Backoff) (ConsistencyReport, error) {
+	var report ConsistencyReport
+
+	err := wait.ExponentialBackoffWithContext(ctx, backoff, func(ctx context.Context) (bool, error) {
+		report = v.buildReport(pods, expected)
+		return report.consistent(), nil
+	})
+
+	return report, err
+}
+
+// podDistros holds each distribution's parsed feed for a single pod,
+// alongside that distribution's own fetch/parse error, if any. The errors
+// are tracked per distribution rather than short-circuiting the whole pod
+// so that, say, a glitched K3s endpoint doesn't hide an otherwise-good RKE2
+// digest for that same pod.
+type podDistros struct {
+	RKE2    RKE2Releases
+	RKE2Err error
+
+	K3s    K3sReleases
+	K3sErr error
+
+	RKE1    RKEReleases
+	RKE1Err error
+
+	UIDriver    UIDriverMetadata
+	UIDriverErr error
+}
+
+func (v *Verifier) buildReport(pods []corev1.Pod, expected ExpectedVersions) ConsistencyReport {
+	report := ConsistencyReport{
+		PerPod:        map[string]DistroDigests{},
+		StaleVersions: map[string][]string{},
+		FetchErrors:   map[string][]string{},
+	}
+
+	raw := map[string]podDistros{}
+	for _, pod := range pods {
+		d := v.fetchPod(pod)
+		raw[pod.Name] = d
+
+		digests := DistroDigests{}
+		if d.RKE2Err == nil {
+			digests.RKE2 = canonicalHash(d.RKE2)
+		} else {
+			report.FetchErrors["rke2"] = append(report.FetchErrors["rke2"], pod.Name)
+		}
+		if d.K3sErr == nil {
+			digests.K3s = canonicalHash(d.K3s)
+		} else {
+			report.FetchErrors["k3s"] = append(report.FetchErrors["k3s"], pod.Name)
+		}
+		if d.RKE1Err == nil {
+			digests.RKE1 = canonicalHash(d.RKE1)
+		} else {
+			report.FetchErrors["rke"] = append(report.FetchErrors["rke"], pod.Name)
+		}
+		if d.UIDriverErr == nil {
+			digests.UIDriver = canonicalHash(d.UIDriver)
+		} else {
+			report.FetchErrors["ui-driver"] = append(report.FetchErrors["ui-driver"], pod.Name)
+		}
+		report.PerPod[pod.Name] = digests
+	}
+
+	report.Divergent = divergentPods(report.PerPod)
+
+	for name, d := range raw {
+		if expected.RKE2 != "" && d.RKE2Err == nil {
+			if _, ok := d.RKE2.RKE2Versions[expected.RKE2]; !ok {
+				report.StaleVersions["rke2"] = append(report.StaleVersions["rke2"], name)
+			}
+		}
+		if expected.K3s != "" && d.K3sErr == nil {
+			if _, ok := d.K3s.K3sVersions[expected.K3s]; !ok {
+				report.StaleVersions["k3s"] = append(report.StaleVersions["k3s"], name)
+			}
+		}
+		if expected.RKE1 != "" && d.RKE1Err == nil {
+			if _, ok := d.RKE1.RKESystemImages[expected.RKE1]; !ok {
+				report.StaleVersions["rke"] = append(report.StaleVersions["rke"], name)
+			}
+		}
+	}
+
+	return report
+}
+
+func (v *Verifier) fetchPod(pod corev1.Pod) podDistros {
+	var d podDistros
+	d.RKE2Err = v.fetchJSON(pod, rke2ReleasesPath, &d.RKE2)
+	d.K3sErr = v.fetchJSON(pod, k3sReleasesPath, &d.K3s)
+	d.RKE1Err = v.fetchJSON(pod, rkeReleasesPath, &d.RKE1)
+	d.UIDriverErr = v.fetchJSON(pod, uiDriverPath, &d.UIDriver)
+	return d
+}
+
+func (v *Verifier) fetchJSON(pod corev1.Pod, path string, out any) error {
+	body := v.exec(pod, curlCmd(path))
+	if err := json.Unmarshal([]byte(body), out); err != nil {
+		return fmt.Errorf("parsing %s response from pod %s: %w", path, pod.Name, err)
+	}
+	return nil
+}
+
+func curlCmd(path string) []string {
+	return []string{"curl", "--insecure", fmt.Sprintf("https://0.0.0.0%s", path)}
+}
+
+func canonicalHash(v any) string {
+	// encoding/json sorts map keys when marshaling, which is what makes this
+	// hash comparable across pods regardless of the order fields were
+	// populated in.
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func divergentPods(perPod map[string]DistroDigests) []string {
+	if len(perPod) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(perPod))
+	for name := range perPod {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	reference := majorityDigests(perPod, names)
+	var divergent []string
+	for _, name := range names {
+		if perPod[name] != reference {
+			divergent = append(divergent, name)
+		}
+	}
+	return divergent
+}
+
+// majorityDigests picks the DistroDigests value held by the most pods, so a
+// single outlier pod is flagged as divergent rather than every other pod
+// being flagged relative to it. Ties are broken by the alphabetically first
+// pod name among the tied values, for a deterministic result.
+func majorityDigests(perPod map[string]DistroDigests, sortedNames []string) DistroDigests {
+	counts := make(map[DistroDigests]int, len(perPod))
+	for _, name := range sortedNames {
+		counts[perPod[name]]++
+	}
+
+	var reference DistroDigests
+	best := 0
+	for _, name := range sortedNames {
+		digests := perPod[name]
+		if counts[digests] > best {
+			reference = digests
+			best = counts[digests]
+		}
+	}
+	return reference
+}
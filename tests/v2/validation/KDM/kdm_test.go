@@ -5,6 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	v3 "github.com/rancher/rancher/pkg/apis/management.cattle.io/v3"
+	"github.com/rancher/rancher/pkg/deploymentwait"
+	"github.com/rancher/rancher/pkg/kdm"
+	"github.com/rancher/rancher/pkg/kdm/verify"
 	"github.com/rancher/shepherd/clients/rancher"
 	management "github.com/rancher/shepherd/clients/rancher/generated/management/v3"
 	stevev1 "github.com/rancher/shepherd/clients/rancher/v1"
@@ -29,8 +32,9 @@ import (
 const (
 	rancherDeployment    = "rancher"
 	rancherNamespace     = "cattle-system"
-	rancherLabelSelector = "app=rancher"
 	rkeMetadataConfig    = "rke-metadata-config"
+	leaderLeaseName      = "cattle-controllers"
+	leaderLeaseNamespace = "kube-system"
 )
 
 var defaultBackoff = wait.Backoff{
@@ -73,25 +77,85 @@ func (k *KDMTestSuite) TearDownSuite() {
 	k.session.Cleanup()
 }
 
-func (k *KDMTestSuite) updateKDMurl(value string) {
-	// Use the Steve client instead of the main one to be able to set a setting's value to an empty string.
-	existing, err := k.client.Steve.SteveType("management.cattle.io.setting").ByID(rkeMetadataConfig)
-	k.Require().NoError(err, "error getting existing setting")
+// steveSettingUpdater implements kdm.SettingUpdater against the Steve
+// client, which is needed instead of the main client to be able to set a
+// setting's value to an empty string.
+type steveSettingUpdater struct {
+	k *KDMTestSuite
+}
+
+func (s steveSettingUpdater) KDMSettingValue() (map[string]string, error) {
+	existing, err := s.k.client.Steve.SteveType("management.cattle.io.setting").ByID(rkeMetadataConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error getting existing setting: %w", err)
+	}
 
 	var kdmSetting v3.Setting
-	err = stevev1.ConvertToK8sType(existing.JSONResp, &kdmSetting)
-	k.Require().NoError(err, "error converting existing setting")
+	if err := stevev1.ConvertToK8sType(existing.JSONResp, &kdmSetting); err != nil {
+		return nil, fmt.Errorf("error converting existing setting: %w", err)
+	}
+
+	value := map[string]string{}
+	if err := json.Unmarshal([]byte(kdmSetting.Value), &value); err != nil {
+		return nil, fmt.Errorf("error unmarshaling existing setting: %w", err)
+	}
+	return value, nil
+}
+
+func (s steveSettingUpdater) SetKDMSettingValue(value map[string]string) error {
+	existing, err := s.k.client.Steve.SteveType("management.cattle.io.setting").ByID(rkeMetadataConfig)
+	if err != nil {
+		return fmt.Errorf("error getting existing setting: %w", err)
+	}
 
-	kdmData := map[string]string{}
-	err = json.Unmarshal([]byte(kdmSetting.Value), &kdmData)
-	k.Require().NoError(err, "error unmarshaling existing setting")
+	var kdmSetting v3.Setting
+	if err := stevev1.ConvertToK8sType(existing.JSONResp, &kdmSetting); err != nil {
+		return fmt.Errorf("error converting existing setting: %w", err)
+	}
 
-	kdmData["url"] = value
-	val, err := json.Marshal(kdmData)
-	k.Require().NoError(err, "error marshaling existing setting")
+	val, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("error marshaling existing setting: %w", err)
+	}
 	kdmSetting.Value = string(val)
-	_, err = k.client.Steve.SteveType("management.cattle.io.setting").Update(existing, kdmSetting)
-	k.Require().NoError(err, "error updating setting")
+
+	_, err = s.k.client.Steve.SteveType("management.cattle.io.setting").Update(existing, kdmSetting)
+	return err
+}
+
+// SetKDMSource points Rancher's rke-metadata-config setting at src, patching
+// the rancher deployment if src needs to mount data into it, and registers
+// src's rollback to run during test teardown.
+func (k *KDMTestSuite) SetKDMSource(src kdm.KDMSource) {
+	target := kdm.Target{
+		Settings:       steveSettingUpdater{k},
+		Clientset:      k.clientset,
+		Namespace:      rancherNamespace,
+		DeploymentName: rancherDeployment,
+	}
+
+	rollback, err := src.Apply(context.TODO(), target)
+	k.Require().NoError(err, "error applying kdm source %s", src.Name())
+
+	k.T().Cleanup(func() {
+		if err := rollback(context.TODO()); err != nil {
+			k.T().Logf("error rolling back kdm source %s: %s", src.Name(), err)
+		}
+	})
+}
+
+// buildKDMPayload marshals a minimal data.json payload advertising
+// rke2Version as the latest available RKE2 release, for sources that embed
+// their own KDM bundle instead of fetching one.
+func (k *KDMTestSuite) buildKDMPayload(rke2Version string) []byte {
+	payload := map[string]any{
+		"rke2Versions": map[string]any{
+			rke2Version: map[string]any{},
+		},
+	}
+	data, err := json.Marshal(payload)
+	k.Require().NoError(err, "error marshaling kdm payload")
+	return data
 }
 
 func (k *KDMTestSuite) ScaleRancherTo(desiredReplicas int32) {
@@ -99,39 +163,67 @@ func (k *KDMTestSuite) ScaleRancherTo(desiredReplicas int32) {
 	deployment, err := k.clientset.AppsV1().Deployments(rancherNamespace).Get(context.TODO(), rancherDeployment, metav1.GetOptions{})
 	k.Require().NoError(err, "error getting rancher deployment")
 
-	// Scale the deployment to desired replicas
-	if deployment.Spec.Replicas == &desiredReplicas {
-		return
+	// Only the Update call is skippable when already at the desired replica count - the
+	// rollout still has to be verified ready below, since a caller might be relying on this
+	// call to gate on readiness even when it isn't actually changing the replica count.
+	if deployment.Spec.Replicas == nil || *deployment.Spec.Replicas != desiredReplicas {
+		deployment.Spec.Replicas = &desiredReplicas
+
+		// Update the deployment with the new replica count
+		_, err = k.clientset.AppsV1().Deployments(rancherNamespace).Update(context.TODO(), deployment, metav1.UpdateOptions{})
+		k.Require().NoError(err, "error updating rancher deployment")
 	}
-	deployment.Spec.Replicas = &desiredReplicas
 
-	// Update the deployment with the new replica count
-	deployment, err = k.clientset.AppsV1().Deployments(rancherNamespace).Update(context.TODO(), deployment, metav1.UpdateOptions{})
-	k.Require().NoError(err, "error updating rancher deployment")
+	// Wait for the rollout to actually settle on its new ReplicaSet rather than just a
+	// matching ready count, which can be satisfied while stale pods are still around.
+	fmt.Printf("Waiting for deployment %s to roll out to %d replicas\n", rancherDeployment, desiredReplicas)
+	_, err = deploymentwait.WaitForRollout(context.TODO(), k.clientset, rancherNamespace, rancherDeployment, defaultBackoff)
+	k.Require().NoError(err, "error scaling rancher deployment, timed out")
+}
 
-	// Wait for the deployment to scale up using exponential defaultBackoff
-	err = wait.ExponentialBackoff(defaultBackoff, func() (bool, error) {
-		// Get the updated deployment
-		deployment, err = k.clientset.AppsV1().Deployments(rancherNamespace).Get(context.TODO(), rancherDeployment, metav1.GetOptions{})
+func (k *KDMTestSuite) GetRancherReplicas() *v1.PodList {
+	pods, err := deploymentwait.WaitForRollout(context.TODO(), k.clientset, rancherNamespace, rancherDeployment, defaultBackoff)
+	k.Require().NoError(err, "error waiting for rancher deployment rollout")
+	return pods
+}
+
+// CurrentLeader returns the holderIdentity of the cattle-controllers lease,
+// identifying the rancher pod currently running the leader-elected
+// controllers responsible for driving KDM refresh.
+func (k *KDMTestSuite) CurrentLeader() string {
+	lease, err := k.clientset.CoordinationV1().Leases(leaderLeaseNamespace).Get(context.TODO(), leaderLeaseName, metav1.GetOptions{})
+	k.Require().NoError(err, "error getting %s lease", leaderLeaseName)
+	k.Require().NotNil(lease.Spec.HolderIdentity, "%s lease has no holder", leaderLeaseName)
+	return *lease.Spec.HolderIdentity
+}
+
+// WaitForNewLeader blocks, using defaultBackoff, until the cattle-controllers
+// lease's holderIdentity changes away from previous, and returns the new
+// holder.
+func (k *KDMTestSuite) WaitForNewLeader(previous string) string {
+	var newLeader string
+	err := wait.ExponentialBackoff(defaultBackoff, func() (bool, error) {
+		lease, err := k.clientset.CoordinationV1().Leases(leaderLeaseNamespace).Get(context.TODO(), leaderLeaseName, metav1.GetOptions{})
 		if err != nil {
-			return false, fmt.Errorf("Error getting deployment: %s", err.Error())
+			return false, fmt.Errorf("error getting %s lease: %s", leaderLeaseName, err.Error())
 		}
-
-		// Check if the deployment has the desired number of replicas
-		if deployment.Status.ReadyReplicas == desiredReplicas {
-			fmt.Printf("Deployment %s successfully scaled to %d replicas\n", rancherDeployment, desiredReplicas)
-			return true, nil
+		if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == previous {
+			return false, nil
 		}
-		fmt.Printf("Waiting for deployment %s to scale. Current replicas: %d/%d\n", rancherDeployment, deployment.Status.ReadyReplicas, desiredReplicas)
-		return false, nil
+		newLeader = *lease.Spec.HolderIdentity
+		return true, nil
 	})
-	k.Require().NoError(err, "error scaling rancher deployment, timed out")
+	k.Require().NoError(err, "error waiting for a new leader to be elected")
+	return newLeader
 }
 
-func (k *KDMTestSuite) GetRancherReplicas() *v1.PodList {
-	podList, err := k.clientset.CoreV1().Pods(rancherNamespace).List(context.TODO(), metav1.ListOptions{LabelSelector: rancherLabelSelector})
-	k.Require().NoError(err, "error getting rancher pod list")
-	return podList
+// leaderPodName strips the random suffix client-go's leader election appends
+// to a lease holderIdentity (pod-name_uuid), leaving the owning pod's name.
+func leaderPodName(holderIdentity string) string {
+	if idx := strings.LastIndex(holderIdentity, "_"); idx != -1 {
+		return holderIdentity[:idx]
+	}
+	return holderIdentity
 }
 
 func (k *KDMTestSuite) ExecCMDForKDMDump(pod v1.Pod, cmd []string) string {
@@ -162,16 +254,35 @@ func (k *KDMTestSuite) ExecCMDForKDMDump(pod v1.Pod, cmd []string) string {
 	return stdout.String()
 }
 
+// TestChangeKDMurl exercises every KDMSource implementation: a publicly
+// reachable URL (the original dev/release refresh scenario), an inline
+// data.json sideloaded through a ConfigMap the kdm package creates, and a
+// caller-supplied ConfigMap standing in for an air-gapped bundle.
 func (k *KDMTestSuite) TestChangeKDMurl() {
+	tests := []struct {
+		name string
+		run  func()
+	}{
+		{name: "url", run: k.assertURLSourceRefresh},
+		{name: "inline-json", run: k.assertInlineJSONSource},
+		{name: "configmap", run: k.assertConfigMapSource},
+	}
+
+	for _, tt := range tests {
+		k.Run(tt.name, tt.run)
+	}
+}
+
+func (k *KDMTestSuite) assertURLSourceRefresh() {
 	// change kdm url to dev
-	k.updateKDMurl("https://releases.rancher.com/kontainer-driver-metadata/dev-v2.8/data.json")
+	k.SetKDMSource(kdm.URLSource{URL: "https://releases.rancher.com/kontainer-driver-metadata/dev-v2.8/data.json"})
 	// scale Rancher to 3 replicas
 	k.ScaleRancherTo(3)
 	// get the current release value
 	currentLatestRKE2Version, err := kubernetesversions.Default(k.client, clusters.RKE2ClusterType.String(), []string{})
 	k.Require().NoError(err, "error getting kubernetes version")
 	// change kdm url to release
-	k.updateKDMurl("https://releases.rancher.com/kontainer-driver-metadata/release-v2.8/data.json")
+	k.SetKDMSource(kdm.URLSource{URL: "https://releases.rancher.com/kontainer-driver-metadata/release-v2.8/data.json"})
 
 	var updatedRKE2Version []string
 	// check latest Release value
@@ -186,23 +297,134 @@ func (k *KDMTestSuite) TestChangeKDMurl() {
 		}
 		return false, nil
 	})
-	if updatedRKE2Version[0] != currentLatestRKE2Version[0] {
-		// look for updated version in all Rancher Pod
+	if err == wait.ErrWaitTimeout && updatedRKE2Version[0] == currentLatestRKE2Version[0] {
+		// This is the scenario where both release and dev version of KDM have same latest version
+		k.T().Log("release and dev KDM report the same latest version, nothing to assert")
+		return
+	}
+	k.Require().NoError(err, "error waiting for kdm refresh")
+
+	k.assertKDMConsistency(verify.ExpectedVersions{RKE2: updatedRKE2Version[0]})
+}
+
+func (k *KDMTestSuite) assertInlineJSONSource() {
+	const rke2Version = "v1.30.0+rke2r1"
+
+	k.SetKDMSource(kdm.InlineJSONSource{Data: k.buildKDMPayload(rke2Version)})
+	k.ScaleRancherTo(3)
+
+	k.assertKDMConsistency(verify.ExpectedVersions{RKE2: rke2Version})
+}
+
+func (k *KDMTestSuite) assertConfigMapSource() {
+	const rke2Version = "v1.29.4+rke2r1"
+	const configMapName = "kdm-offline-bundle"
+
+	_, err := k.clientset.CoreV1().ConfigMaps(rancherNamespace).Create(context.TODO(), &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: configMapName, Namespace: rancherNamespace},
+		Data:       map[string]string{"data.json": string(k.buildKDMPayload(rke2Version))},
+	}, metav1.CreateOptions{})
+	k.Require().NoError(err, "error creating offline kdm configmap")
+	k.T().Cleanup(func() {
+		_ = k.clientset.CoreV1().ConfigMaps(rancherNamespace).Delete(context.TODO(), configMapName, metav1.DeleteOptions{})
+	})
+
+	k.SetKDMSource(kdm.ConfigMapSource{ConfigMapName: configMapName})
+	k.ScaleRancherTo(3)
+
+	k.assertKDMConsistency(verify.ExpectedVersions{RKE2: rke2Version})
+}
+
+// assertKDMConsistency waits for every rancher replica to agree on, and
+// actually contain, the expected KDM versions, failing the test with a full
+// per-pod diff table if any replica remains divergent or stale past the
+// backoff window.
+func (k *KDMTestSuite) assertKDMConsistency(expected verify.ExpectedVersions) {
+	pods := k.GetRancherReplicas()
+	report, err := verify.New(k.ExecCMDForKDMDump).WaitForConsistency(context.TODO(), pods.Items, expected, defaultBackoff)
+	if err != nil {
+		k.Require().Failf("rancher pods never reached consistent KDM data", "%s\n%s", err, report.DiffTable())
+	}
+}
+
+// TestKDMSourceFailureModes asserts Rancher degrades predictably, rather
+// than silently, when a KDMSource is corrupted or unreachable.
+func (k *KDMTestSuite) TestKDMSourceFailureModes() {
+	k.Run("corrupted-inline-json", func() {
+		k.SetKDMSource(kdm.InlineJSONSource{Data: []byte("{not valid json")})
+		k.ScaleRancherTo(3)
 
-		// Command to execute in the pods
-		cmd := []string{"curl", "--insecure", "https://0.0.0.0/v1-rke2-release/releases"}
 		pods := k.GetRancherReplicas()
+		report, err := verify.New(k.ExecCMDForKDMDump).WaitForConsistency(context.TODO(), pods.Items, verify.ExpectedVersions{}, defaultBackoff)
+		k.Require().Error(err, "expected kdm consistency check to fail against a corrupted payload")
+
+		podNames := make([]string, 0, len(pods.Items))
 		for _, pod := range pods.Items {
-			fmt.Println(pod.Name)
-			output := k.ExecCMDForKDMDump(pod, cmd)
-			if !strings.Contains(output, updatedRKE2Version[0]) {
-				k.Require().Error(fmt.Errorf("found KDM from a pod:%v not matching with the latest known version:%v", pod.Name, updatedRKE2Version[0]))
-			}
+			podNames = append(podNames, pod.Name)
 		}
-	} else {
-		// This is the scenario where both release and dev version of KDM have same latest version
-		fmt.Println("nothing to assert here")
+		k.Require().ElementsMatch(podNames, report.FetchErrors["rke2"], "expected every pod to reject the corrupted kdm payload instead of silently serving something parseable")
+	})
+
+	k.Run("unreachable-url", func() {
+		k.SetKDMSource(kdm.URLSource{URL: "https://releases.invalid.example/kontainer-driver-metadata/data.json"})
+		k.ScaleRancherTo(3)
+
+		err := wait.ExponentialBackoff(defaultBackoff, func() (bool, error) {
+			_, err := kubernetesversions.Default(k.client, clusters.RKE2ClusterType.String(), []string{})
+			return err == nil, nil
+		})
+		k.Require().Error(err, "expected kubernetes version lookup to keep failing against an unreachable kdm source")
+	})
+}
+
+// TestKDMRefreshAfterLeaderFailover verifies that KDM refresh, which is
+// driven by the leader-elected controllers, is correctly re-triggered by
+// the new leader after a failover - not just by whichever pod happened to
+// be leader when the KDM URL changed.
+func (k *KDMTestSuite) TestKDMRefreshAfterLeaderFailover() {
+	// scale explicitly rather than relying on a prior test in the suite having done
+	// it already, so this test is still a real failover when run in isolation
+	k.ScaleRancherTo(3)
+
+	previousLeader := k.CurrentLeader()
+
+	// capture the pre-switch version so a refresh that silently never happened - the new
+	// leader still serving what was already cached - can't be mistaken for success
+	baselineRKE2Version, err := kubernetesversions.Default(k.client, clusters.RKE2ClusterType.String(), []string{})
+	k.Require().NoError(err, "error getting kubernetes version")
+
+	// change kdm url to dev
+	k.SetKDMSource(kdm.URLSource{URL: "https://releases.rancher.com/kontainer-driver-metadata/dev-v2.8/data.json"})
+
+	// delete the leader pod immediately, before the refresh interval elapses, to force a failover
+	leaderPod := leaderPodName(previousLeader)
+	err = k.clientset.CoreV1().Pods(rancherNamespace).Delete(context.TODO(), leaderPod, metav1.DeleteOptions{})
+	k.Require().NoError(err, "error deleting leader pod %s", leaderPod)
+
+	newLeader := k.WaitForNewLeader(previousLeader)
+	k.Require().NotEqual(previousLeader, newLeader, "expected a new leader to be elected after deleting %s", leaderPod)
+
+	// wait for the deployment to recover its full replica count after losing the leader pod
+	_, err = deploymentwait.WaitForRollout(context.TODO(), k.clientset, rancherNamespace, rancherDeployment, defaultBackoff)
+	k.Require().NoError(err, "error waiting for rancher deployment to recover after leader failover")
+
+	var devRKE2Version []string
+	err = wait.ExponentialBackoff(defaultBackoff, func() (bool, error) {
+		devRKE2Version, err = kubernetesversions.Default(k.client, clusters.RKE2ClusterType.String(), []string{})
+		if err != nil {
+			return false, fmt.Errorf("error getting kubernetes version: %s", err.Error())
+		}
+		return devRKE2Version[0] != baselineRKE2Version[0], nil
+	})
+	if err == wait.ErrWaitTimeout && devRKE2Version[0] == baselineRKE2Version[0] {
+		// dev KDM reports the same latest version the cluster was already on before the
+		// failover, so a silently-skipped refresh can't be distinguished from a published one
+		k.T().Log("dev and pre-switch KDM report the same latest version, nothing to assert")
+		return
 	}
+	k.Require().NoError(err, "error waiting for the new leader to publish the dev kdm contents")
+
+	k.assertKDMConsistency(verify.ExpectedVersions{RKE2: devRKE2Version[0]})
 }
 
 func TestKDM(t *testing.T) {